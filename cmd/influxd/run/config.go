@@ -180,6 +180,10 @@ func (c *Config) Validate() error {
 		return err
 	}
 
+	if err := c.HTTPD.Validate(); err != nil {
+		return fmt.Errorf("invalid http config: %v", err)
+	}
+
 	for _, graphite := range c.GraphiteInputs {
 		if err := graphite.Validate(); err != nil {
 			return fmt.Errorf("invalid graphite config: %v", err)
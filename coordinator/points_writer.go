@@ -29,8 +29,9 @@ const (
 )
 
 var (
-	// ErrTimeout is returned when a write times out.
-	ErrTimeout = errors.New("timeout")
+	// ErrTimeout is returned when a write times out. It is a temporary
+	// error, so the write may be retried.
+	ErrTimeout error = timeoutError{}
 
 	// ErrPartialWrite is returned when a write partially succeeds but does
 	// not meet the requested consistency level.
@@ -40,6 +41,12 @@ var (
 	ErrWriteFailed = errors.New("write failed")
 )
 
+// timeoutError is the type of ErrTimeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Temporary() bool { return true }
+
 // PointsWriter handles writes across multiple local and remote data nodes.
 type PointsWriter struct {
 	mu           sync.RWMutex
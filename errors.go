@@ -28,6 +28,15 @@ func IsAuthorizationError(err error) bool {
 	return ok && e.AuthorizationFailed()
 }
 
+// IsTemporaryError indicates whether an error is due to a transient condition
+// and the failed operation may succeed if it is retried.
+func IsTemporaryError(err error) bool {
+	e, ok := err.(interface {
+		Temporary() bool
+	})
+	return ok && e.Temporary()
+}
+
 // IsClientError indicates whether an error is a known client error.
 func IsClientError(err error) bool {
 	if err == nil {
@@ -2,6 +2,9 @@ package httpd
 
 import (
 	"crypto/tls"
+	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/influxdata/influxdb/monitor/diagnostics"
@@ -12,6 +15,10 @@ const (
 	// DefaultBindAddress is the default address to bind to.
 	DefaultBindAddress = ":8086"
 
+	// DefaultBindNetwork is the default network to listen on. "tcp" listens
+	// on both IPv4 and IPv6 where the platform supports it.
+	DefaultBindNetwork = "tcp"
+
 	// DefaultRealm is the default realm sent back when issuing a basic auth challenge.
 	DefaultRealm = "InfluxDB"
 
@@ -23,55 +30,98 @@ const (
 
 	// DefaultEnqueuedWriteTimeout is the maximum time a write request can wait to be processed.
 	DefaultEnqueuedWriteTimeout = 30 * time.Second
+
+	// DefaultEnqueuedQueryTimeout is the maximum time a query request can wait to be processed.
+	DefaultEnqueuedQueryTimeout = 30 * time.Second
+
+	// DefaultMaxMeasurementNameLength is the default maximum length of a measurement
+	// name, in bytes, when measurement name validation is enabled.
+	DefaultMaxMeasurementNameLength = 255
 )
 
 // Config represents a configuration for a HTTP service.
 type Config struct {
-	Enabled                 bool          `toml:"enabled"`
-	BindAddress             string        `toml:"bind-address"`
-	AuthEnabled             bool          `toml:"auth-enabled"`
-	LogEnabled              bool          `toml:"log-enabled"`
-	SuppressWriteLog        bool          `toml:"suppress-write-log"`
-	WriteTracing            bool          `toml:"write-tracing"`
-	PprofEnabled            bool          `toml:"pprof-enabled"`
-	DebugPprofEnabled       bool          `toml:"debug-pprof-enabled"`
-	HTTPSEnabled            bool          `toml:"https-enabled"`
-	HTTPSCertificate        string        `toml:"https-certificate"`
-	HTTPSPrivateKey         string        `toml:"https-private-key"`
-	MaxRowLimit             int           `toml:"max-row-limit"`
-	MaxConnectionLimit      int           `toml:"max-connection-limit"`
-	SharedSecret            string        `toml:"shared-secret"`
-	Realm                   string        `toml:"realm"`
-	UnixSocketEnabled       bool          `toml:"unix-socket-enabled"`
-	UnixSocketGroup         *toml.Group   `toml:"unix-socket-group"`
-	UnixSocketPermissions   toml.FileMode `toml:"unix-socket-permissions"`
-	BindSocket              string        `toml:"bind-socket"`
-	MaxBodySize             int           `toml:"max-body-size"`
-	AccessLogPath           string        `toml:"access-log-path"`
-	MaxConcurrentWriteLimit int           `toml:"max-concurrent-write-limit"`
-	MaxEnqueuedWriteLimit   int           `toml:"max-enqueued-write-limit"`
-	EnqueuedWriteTimeout    time.Duration `toml:"enqueued-write-timeout"`
-	TLS                     *tls.Config   `toml:"-"`
+	Enabled                          bool          `toml:"enabled"`
+	BindAddress                      string        `toml:"bind-address"`
+	BindNetwork                      string        `toml:"bind-network"`
+	PathPrefix                       string        `toml:"path-prefix"`
+	AuthEnabled                      bool          `toml:"auth-enabled"`
+	LogEnabled                       bool          `toml:"log-enabled"`
+	SuppressWriteLog                 bool          `toml:"suppress-write-log"`
+	WriteTracing                     bool          `toml:"write-tracing"`
+	PprofEnabled                     bool          `toml:"pprof-enabled"`
+	PprofAuthEnabled                 bool          `toml:"pprof-auth-enabled"`
+	DebugAuthEnabled                 bool          `toml:"debug-auth-enabled"`
+	DebugPprofEnabled                bool          `toml:"debug-pprof-enabled"`
+	HTTPSEnabled                     bool          `toml:"https-enabled"`
+	HTTPSCertificate                 string        `toml:"https-certificate"`
+	HTTPSPrivateKey                  string        `toml:"https-private-key"`
+	MaxRowLimit                      int           `toml:"max-row-limit"`
+	FloatPrecision                   int           `toml:"float-precision"`
+	MaxConnectionLimit               int           `toml:"max-connection-limit"`
+	SharedSecret                     string        `toml:"shared-secret"`
+	Realm                            string        `toml:"realm"`
+	UnixSocketEnabled                bool          `toml:"unix-socket-enabled"`
+	UnixSocketGroup                  *toml.Group   `toml:"unix-socket-group"`
+	UnixSocketPermissions            toml.FileMode `toml:"unix-socket-permissions"`
+	BindSocket                       string        `toml:"bind-socket"`
+	MaxBodySize                      int           `toml:"max-body-size"`
+	ValidateMeasurementNames         bool          `toml:"validate-measurement-names"`
+	MaxMeasurementNameLength         int           `toml:"max-measurement-name-length"`
+	MeasurementNameAllowControlChars bool          `toml:"measurement-name-allow-control-chars"`
+	MeasurementNamePattern           string        `toml:"measurement-name-pattern"`
+	AccessLogPath                    string        `toml:"access-log-path"`
+	MaxConcurrentWriteLimit          int           `toml:"max-concurrent-write-limit"`
+	MaxEnqueuedWriteLimit            int           `toml:"max-enqueued-write-limit"`
+	EnqueuedWriteTimeout             time.Duration `toml:"enqueued-write-timeout"`
+	MaxConcurrentQueryLimit          int           `toml:"max-concurrent-query-limit"`
+	MaxEnqueuedQueryLimit            int           `toml:"max-enqueued-query-limit"`
+	EnqueuedQueryTimeout             time.Duration `toml:"enqueued-query-timeout"`
+	TLS                              *tls.Config   `toml:"-"`
 }
 
 // NewConfig returns a new Config with default settings.
 func NewConfig() Config {
 	return Config{
-		Enabled:               true,
-		BindAddress:           DefaultBindAddress,
-		LogEnabled:            true,
-		PprofEnabled:          true,
-		DebugPprofEnabled:     false,
-		HTTPSEnabled:          false,
-		HTTPSCertificate:      "/etc/ssl/influxdb.pem",
-		MaxRowLimit:           0,
-		Realm:                 DefaultRealm,
-		UnixSocketEnabled:     false,
-		UnixSocketPermissions: 0777,
-		BindSocket:            DefaultBindSocket,
-		MaxBodySize:           DefaultMaxBodySize,
-		EnqueuedWriteTimeout:  DefaultEnqueuedWriteTimeout,
+		Enabled:                  true,
+		BindAddress:              DefaultBindAddress,
+		BindNetwork:              DefaultBindNetwork,
+		LogEnabled:               true,
+		PprofEnabled:             true,
+		DebugPprofEnabled:        false,
+		HTTPSEnabled:             false,
+		HTTPSCertificate:         "/etc/ssl/influxdb.pem",
+		MaxRowLimit:              0,
+		Realm:                    DefaultRealm,
+		UnixSocketEnabled:        false,
+		UnixSocketPermissions:    0777,
+		BindSocket:               DefaultBindSocket,
+		MaxBodySize:              DefaultMaxBodySize,
+		ValidateMeasurementNames: true,
+		MaxMeasurementNameLength: DefaultMaxMeasurementNameLength,
+		EnqueuedWriteTimeout:     DefaultEnqueuedWriteTimeout,
+		EnqueuedQueryTimeout:     DefaultEnqueuedQueryTimeout,
+	}
+}
+
+// Validate returns an error if the config is invalid.
+func (c Config) Validate() error {
+	if c.PathPrefix != "" && !strings.HasPrefix(c.PathPrefix, "/") {
+		return fmt.Errorf("invalid path-prefix %q: must start with /", c.PathPrefix)
+	}
+
+	switch c.BindNetwork {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("invalid bind-network %q: must be tcp, tcp4 or tcp6", c.BindNetwork)
+	}
+
+	if c.MeasurementNamePattern != "" {
+		if _, err := regexp.Compile(c.MeasurementNamePattern); err != nil {
+			return fmt.Errorf("invalid measurement-name-pattern: %s", err)
+		}
 	}
+	return nil
 }
 
 // Diagnostics returns a diagnostics representation of a subset of the Config.
@@ -85,6 +135,7 @@ func (c Config) Diagnostics() (*diagnostics.Diagnostics, error) {
 	return diagnostics.RowFromMap(map[string]interface{}{
 		"enabled":              true,
 		"bind-address":         c.BindAddress,
+		"path-prefix":          c.PathPrefix,
 		"https-enabled":        c.HTTPSEnabled,
 		"max-row-limit":        c.MaxRowLimit,
 		"max-connection-limit": c.MaxConnectionLimit,
@@ -56,3 +56,44 @@ func TestConfig_WriteTracing(t *testing.T) {
 		t.Fatalf("write tracing was not set")
 	}
 }
+
+func TestConfig_Validate_MeasurementNamePattern(t *testing.T) {
+	c := httpd.NewConfig()
+	c.MeasurementNamePattern = `^[a-z]+$`
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c.MeasurementNamePattern = `^[a-z+$`
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected error for invalid pattern")
+	}
+}
+
+func TestConfig_Validate_BindNetwork(t *testing.T) {
+	c := httpd.NewConfig()
+	for _, network := range []string{"tcp", "tcp4", "tcp6"} {
+		c.BindNetwork = network
+		if err := c.Validate(); err != nil {
+			t.Fatalf("%s: unexpected error: %s", network, err)
+		}
+	}
+
+	c.BindNetwork = "udp"
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected error for invalid network")
+	}
+}
+
+func TestConfig_Validate_PathPrefix(t *testing.T) {
+	c := httpd.NewConfig()
+	c.PathPrefix = "/influxdb"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c.PathPrefix = "influxdb"
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected error for prefix without a leading slash")
+	}
+}
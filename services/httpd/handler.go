@@ -12,13 +12,17 @@ import (
 	"io/ioutil"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"os"
+	"regexp"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/bmizerany/pat"
 	"github.com/dgrijalva/jwt-go"
@@ -83,6 +87,7 @@ type Route struct {
 // Handler represents an HTTP handler for the InfluxDB server.
 type Handler struct {
 	mux       *pat.PatternServeMux
+	methods   map[string][]string // methods registered for each route pattern
 	Version   string
 	BuildType string
 
@@ -125,25 +130,51 @@ type Handler struct {
 	accessLog *os.File
 	stats     *Statistics
 
-	requestTracker *RequestTracker
-	writeThrottler *Throttler
+	connMu sync.Mutex
+	conns  map[net.Conn]http.ConnState // state of each open connection
+
+	requestTracker            *RequestTracker
+	measurementNamePattern    *regexp.Regexp
+	measurementNamePatternErr error // set if the pattern does not compile
+	writeThrottler            *Throttler
+	queryThrottler            *Throttler
 }
 
 // NewHandler returns a new instance of handler with routes.
 func NewHandler(c Config) *Handler {
 	h := &Handler{
 		mux:            pat.New(),
+		methods:        make(map[string][]string),
 		Config:         &c,
 		Logger:         zap.NewNop(),
 		CLFLogger:      log.New(os.Stderr, "[httpd] ", 0),
 		stats:          &Statistics{},
+		conns:          make(map[net.Conn]http.ConnState),
 		requestTracker: NewRequestTracker(),
 	}
 
+	// Respond with a structured error for requests that do not match a route.
+	h.mux.NotFound = h.recovery(requestID(http.HandlerFunc(h.serveNotFound)), "not-found")
+
+	// The pattern is normally checked by Config.Validate. If it is invalid
+	// anyway, the error is kept and writes are refused rather than accepted
+	// without the pattern being applied.
+	if c.MeasurementNamePattern != "" {
+		re, err := regexp.Compile(c.MeasurementNamePattern)
+		if err != nil {
+			h.measurementNamePatternErr = fmt.Errorf("invalid measurement-name-pattern: %s", err)
+		}
+		h.measurementNamePattern = re
+	}
+
 	// Limit the number of concurrent & enqueued write requests.
 	h.writeThrottler = NewThrottler(c.MaxConcurrentWriteLimit, c.MaxEnqueuedWriteLimit)
 	h.writeThrottler.EnqueueTimeout = c.EnqueuedWriteTimeout
 
+	// Limit the number of concurrent & enqueued query requests.
+	h.queryThrottler = NewThrottler(c.MaxConcurrentQueryLimit, c.MaxEnqueuedQueryLimit)
+	h.queryThrottler.EnqueueTimeout = c.EnqueuedQueryTimeout
+
 	// Disable the write log if they have been suppressed.
 	writeLogEnabled := c.LogEnabled
 	if c.SuppressWriteLog {
@@ -163,6 +194,10 @@ func NewHandler(c Config) *Handler {
 			"query", // Query serving route.
 			"POST", "/query", true, true, h.serveQuery,
 		},
+		Route{
+			"query-head", // Query headers only; the server drops the body.
+			"HEAD", "/query", true, true, h.serveQuery,
+		},
 		Route{
 			"write-options", // Satisfy CORS checks.
 			"OPTIONS", "/write", false, true, h.serveOptions,
@@ -171,18 +206,34 @@ func NewHandler(c Config) *Handler {
 			"write", // Data-ingest route.
 			"POST", "/write", true, writeLogEnabled, h.serveWrite,
 		},
+		Route{
+			"prometheus-write-options", // Satisfy CORS checks.
+			"OPTIONS", "/api/v1/prom/write", false, true, h.serveOptions,
+		},
 		Route{
 			"prometheus-write", // Prometheus remote write
 			"POST", "/api/v1/prom/write", false, true, h.servePromWrite,
 		},
+		Route{
+			"prometheus-read-options", // Satisfy CORS checks.
+			"OPTIONS", "/api/v1/prom/read", false, true, h.serveOptions,
+		},
 		Route{
 			"prometheus-read", // Prometheus remote read
 			"POST", "/api/v1/prom/read", true, true, h.servePromRead,
 		},
+		Route{
+			"flux-read-options", // Satisfy CORS checks.
+			"OPTIONS", "/v2/query", false, true, h.serveOptions,
+		},
 		Route{
 			"flux-read", // Prometheus remote read
 			"POST", "/v2/query", true, true, h.serveFluxQuery,
 		},
+		Route{
+			"ping-options", // Satisfy CORS checks.
+			"OPTIONS", "/ping", false, true, h.serveOptions,
+		},
 		Route{ // Ping
 			"ping",
 			"GET", "/ping", false, true, h.servePing,
@@ -191,6 +242,10 @@ func NewHandler(c Config) *Handler {
 			"ping-head",
 			"HEAD", "/ping", false, true, h.servePing,
 		},
+		Route{
+			"status-options", // Satisfy CORS checks.
+			"OPTIONS", "/status", false, true, h.serveOptions,
+		},
 		Route{ // Ping w/ status
 			"status",
 			"GET", "/status", false, true, h.serveStatus,
@@ -257,6 +312,10 @@ type Statistics struct {
 	RecoveredPanics              int64
 	PromWriteRequests            int64
 	PromReadRequests             int64
+	Connections                  int64
+	OpenConnections              int64
+	ActiveConnections            int64
+	IdleConnections              int64
 }
 
 // Statistics returns statistics for periodic monitoring.
@@ -286,10 +345,46 @@ func (h *Handler) Statistics(tags map[string]string) []models.Statistic {
 			statRecoveredPanics:              atomic.LoadInt64(&h.stats.RecoveredPanics),
 			statPromWriteRequest:             atomic.LoadInt64(&h.stats.PromWriteRequests),
 			statPromReadRequest:              atomic.LoadInt64(&h.stats.PromReadRequests),
+			statConnections:                  atomic.LoadInt64(&h.stats.Connections),
+			statConnectionsOpen:              atomic.LoadInt64(&h.stats.OpenConnections),
+			statConnectionsActive:            atomic.LoadInt64(&h.stats.ActiveConnections),
+			statConnectionsIdle:              atomic.LoadInt64(&h.stats.IdleConnections),
 		},
 	}}
 }
 
+// ConnState records connection state changes for statistics. It is intended
+// to be used as the ConnState hook of the http.Server serving the handler.
+func (h *Handler) ConnState(conn net.Conn, state http.ConnState) {
+	h.connMu.Lock()
+	defer h.connMu.Unlock()
+
+	if prev, ok := h.conns[conn]; ok {
+		h.addConnState(prev, -1)
+	} else if state == http.StateNew {
+		atomic.AddInt64(&h.stats.Connections, 1)
+	}
+
+	// Hijacked connections are no longer managed by the server.
+	if state == http.StateHijacked || state == http.StateClosed {
+		delete(h.conns, conn)
+		return
+	}
+	h.conns[conn] = state
+	h.addConnState(state, 1)
+}
+
+// addConnState adds delta to the counters for a connection in state.
+func (h *Handler) addConnState(state http.ConnState, delta int64) {
+	atomic.AddInt64(&h.stats.OpenConnections, delta)
+	switch state {
+	case http.StateActive:
+		atomic.AddInt64(&h.stats.ActiveConnections, delta)
+	case http.StateIdle:
+		atomic.AddInt64(&h.stats.IdleConnections, delta)
+	}
+}
+
 // AddRoutes sets the provided routes on the handler.
 func (h *Handler) AddRoutes(routes ...Route) {
 	for _, r := range routes {
@@ -326,6 +421,7 @@ func (h *Handler) AddRoutes(routes ...Route) {
 		handler = h.recovery(handler, r.Name) // make sure recovery is always last
 
 		h.mux.Add(r.Method, r.Pattern, handler)
+		h.methods[r.Pattern] = append(h.methods[r.Pattern], r.Method)
 	}
 }
 
@@ -340,12 +436,39 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("X-Influxdb-Version", h.Version)
 	w.Header().Add("X-Influxdb-Build", h.BuildType)
 
-	if strings.HasPrefix(r.URL.Path, "/debug/pprof") && h.Config.PprofEnabled {
-		h.handleProfiles(w, r)
+	// Strip the configured path prefix so the routes below match. Requests
+	// outside of the prefix are not served.
+	var outsidePrefix bool
+	if prefix := strings.TrimSuffix(h.Config.PathPrefix, "/"); prefix != "" {
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+			if r.URL.Path == "" {
+				r.URL.Path = "/"
+			}
+		} else {
+			outsidePrefix = true
+		}
+	}
+
+	// Requests that are not dispatched through the router are wrapped the
+	// same way as routes so they also carry a request id.
+	var handler http.Handler
+	var name string
+	if outsidePrefix {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		})
+		name = "not-found"
+	} else if strings.HasPrefix(r.URL.Path, "/debug/pprof") && h.Config.PprofEnabled {
+		handler, name = h.adminHandler(h.handleProfiles, h.Config.PprofAuthEnabled), "pprof"
 	} else if strings.HasPrefix(r.URL.Path, "/debug/vars") {
-		h.serveExpvar(w, r)
+		handler, name = h.adminHandler(h.serveExpvar, h.Config.DebugAuthEnabled), "debug-vars"
 	} else if strings.HasPrefix(r.URL.Path, "/debug/requests") {
-		h.serveDebugRequests(w, r)
+		handler, name = h.adminHandler(h.serveDebugRequests, h.Config.DebugAuthEnabled), "debug-requests"
+	}
+
+	if handler != nil {
+		h.recovery(requestID(handler), name).ServeHTTP(w, r)
 	} else {
 		h.mux.ServeHTTP(w, r)
 	}
@@ -353,6 +476,24 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	atomic.AddInt64(&h.stats.RequestDuration, time.Since(start).Nanoseconds())
 }
 
+// adminHandler returns fn as a handler for a /debug endpoint. If both
+// authentication and requireAdmin are enabled, the requester must be an
+// admin user.
+func (h *Handler) adminHandler(fn http.HandlerFunc, requireAdmin bool) http.Handler {
+	if !h.Config.AuthEnabled || !requireAdmin {
+		return fn
+	}
+	return authenticate(func(w http.ResponseWriter, r *http.Request, user meta.User) {
+		// A nil user means no admin user exists yet and authentication
+		// is bypassed to allow bootstrapping the server.
+		if user != nil && !user.AuthorizeUnrestricted() {
+			h.httpError(w, fmt.Sprintf("%q user is not authorized to access %s", user.ID(), r.URL.Path), http.StatusForbidden)
+			return
+		}
+		fn(w, r)
+	}, h, true)
+}
+
 // writeHeader writes the provided status code in the response, and
 // updates relevant http error statistics.
 func (h *Handler) writeHeader(w http.ResponseWriter, code int) {
@@ -382,6 +523,19 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user meta.U
 	// Retrieve the node id the query should be executed on.
 	nodeID, _ := strconv.ParseUint(r.FormValue("node_id"), 10, 64)
 
+	// Parameters may be passed in both the URL and a form-encoded body. The
+	// form value takes precedence so let the operator know when both are used.
+	if len(r.PostForm) > 0 {
+		params := r.URL.Query()
+		for k := range r.PostForm {
+			if _, ok := params[k]; ok {
+				h.Logger.Warn("Query parameter present in both URL and request body, using request body",
+					zap.String("param", k),
+					requestIDField(r))
+			}
+		}
+	}
+
 	var qr io.Reader
 	// Attempt to read the form value from the "q" form value.
 	if qp := strings.TrimSpace(r.FormValue("q")); qp != "" {
@@ -405,6 +559,7 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user meta.U
 	}
 
 	epoch := strings.TrimSpace(r.FormValue("epoch"))
+	int64AsString := r.FormValue("int64_as_string") == "true"
 
 	p := influxql.NewParser(qr)
 	db := r.FormValue("db")
@@ -450,6 +605,16 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user meta.U
 		return
 	}
 
+	// HEAD requests must not change anything on the server.
+	if r.Method == http.MethodHead {
+		for _, stmt := range q.Statements {
+			if !isReadOnlyStatement(stmt) {
+				h.httpError(rw, "only SELECT and SHOW statements are allowed with HEAD", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
 	// Check authorization.
 	if h.Config.AuthEnabled {
 		if err := h.QueryAuthorizer.AuthorizeQuery(user, q, db); err != nil {
@@ -457,13 +622,25 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user meta.U
 				h.Logger.Info("Unauthorized request",
 					zap.String("user", err.User),
 					zap.Stringer("query", err.Query),
-					logger.Database(err.Database))
+					logger.Database(err.Database),
+					requestIDField(r))
 			}
 			h.httpError(rw, "error authorizing query: "+err.Error(), http.StatusForbidden)
 			return
 		}
 	}
 
+	// Limit the number of concurrent & enqueued queries. Queries that only
+	// list or kill running queries are not throttled so they can still be
+	// used when the limit is reached.
+	if !isQueryManagement(q) {
+		release, ok := h.queryThrottler.acquire(rw)
+		if !ok {
+			return
+		}
+		defer release()
+	}
+
 	// Parse chunk size. Use default if not provided or unparsable.
 	chunked := r.FormValue("chunked") == "true"
 	chunkSize := DefaultChunkSize
@@ -480,7 +657,7 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user meta.U
 		Database:        db,
 		RetentionPolicy: r.FormValue("rp"),
 		ChunkSize:       chunkSize,
-		ReadOnly:        r.Method == "GET",
+		ReadOnly:        r.Method == "GET" || r.Method == "HEAD",
 		NodeID:          nodeID,
 	}
 
@@ -524,12 +701,13 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user meta.U
 	}
 
 	// Execute query.
+	start := time.Now()
 	results := h.QueryExecutor.ExecuteQuery(q, opts, closing)
 
 	// If we are running in async mode, open a goroutine to drain the results
 	// and return with a StatusNoContent.
 	if async {
-		go h.async(q, results)
+		go h.async(q, results, h.Logger.With(requestIDField(r)))
 		h.writeHeader(w, http.StatusNoContent)
 		return
 	}
@@ -537,6 +715,12 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user meta.U
 	// if we're not chunking, this will be the in memory buffer for all results before sending to client
 	resp := Response{Results: make([]*query.Result, 0)}
 
+	// The query statistics are only known once all results have been sent, so
+	// they are returned as trailers.
+	var stats queryStats
+	rw.Header().Set("Trailer", strings.Join(queryStatsTrailers, ", "))
+	defer stats.writeTrailers(rw, start)
+
 	// Status header is OK once this point is reached.
 	// Attempt to flush the header immediately so the client gets the header information
 	// and knows the query was accepted.
@@ -558,8 +742,20 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user meta.U
 			convertToEpoch(r, epoch)
 		}
 
+		// Round float values if a precision has been configured.
+		if h.Config.FloatPrecision > 0 {
+			roundFloats(r, h.Config.FloatPrecision)
+		}
+
+		// if requested, encode integers as strings so clients that decode
+		// numbers as doubles do not lose precision
+		if int64AsString {
+			convertIntegersToStrings(r)
+		}
+
 		// Write out result immediately if chunked.
 		if chunked {
+			stats.add(r)
 			n, _ := rw.WriteResponse(Response{
 				Results: []*query.Result{r},
 			})
@@ -619,6 +815,10 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user meta.U
 					if !lastSeries.SameSeries(row) {
 						// Next row is for a different series than last.
 						break
+					} else if !stringsEqual(lastSeries.Columns, row.Columns) {
+						// Values with different columns cannot be combined
+						// without misaligning them, so keep them in a new row.
+						break
 					}
 					// Values are for the same series, so append them.
 					lastSeries.Values = append(lastSeries.Values, row.Values...)
@@ -652,13 +852,96 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user meta.U
 
 	// If it's not chunked we buffered everything in memory, so write it out
 	if !chunked {
+		for _, r := range resp.Results {
+			stats.add(r)
+		}
 		n, _ := rw.WriteResponse(resp)
 		atomic.AddInt64(&h.stats.QueryRequestBytesTransmitted, int64(n))
 	}
 }
 
+// queryStatsTrailers lists the trailers set by queryStats.
+var queryStatsTrailers = []string{
+	"X-Influxdb-Query-Points",
+	"X-Influxdb-Query-Series",
+	"X-Influxdb-Query-Elapsed-Ms",
+}
+
+// queryStats counts the series and points returned by a query.
+type queryStats struct {
+	points int
+	series int
+	last   *models.Row
+}
+
+// add counts the series and points in r. A series that was split across
+// chunks is only counted once.
+func (s *queryStats) add(r *query.Result) {
+	for _, row := range r.Series {
+		if s.last == nil || !s.last.Partial || !s.last.SameSeries(row) {
+			s.series++
+		}
+		s.points += len(row.Values)
+		s.last = row
+	}
+}
+
+// writeTrailers sets the statistics trailers on w. The elapsed time covers
+// executing the query and encoding its results.
+func (s *queryStats) writeTrailers(w http.ResponseWriter, start time.Time) {
+	w.Header().Set("X-Influxdb-Query-Points", strconv.Itoa(s.points))
+	w.Header().Set("X-Influxdb-Query-Series", strconv.Itoa(s.series))
+	w.Header().Set("X-Influxdb-Query-Elapsed-Ms", strconv.FormatFloat(time.Since(start).Seconds()*1000, 'f', 3, 64))
+}
+
+// isReadOnlyStatement returns true if stmt is a SELECT without an INTO
+// clause or a SHOW statement.
+func isReadOnlyStatement(stmt influxql.Statement) bool {
+	switch stmt := stmt.(type) {
+	case *influxql.SelectStatement:
+		return stmt.Target == nil
+	case *influxql.ShowContinuousQueriesStatement,
+		*influxql.ShowDatabasesStatement,
+		*influxql.ShowDiagnosticsStatement,
+		*influxql.ShowFieldKeyCardinalityStatement,
+		*influxql.ShowFieldKeysStatement,
+		*influxql.ShowGrantsForUserStatement,
+		*influxql.ShowMeasurementCardinalityStatement,
+		*influxql.ShowMeasurementsStatement,
+		*influxql.ShowQueriesStatement,
+		*influxql.ShowRetentionPoliciesStatement,
+		*influxql.ShowSeriesCardinalityStatement,
+		*influxql.ShowSeriesStatement,
+		*influxql.ShowShardGroupsStatement,
+		*influxql.ShowShardsStatement,
+		*influxql.ShowStatsStatement,
+		*influxql.ShowSubscriptionsStatement,
+		*influxql.ShowTagKeyCardinalityStatement,
+		*influxql.ShowTagKeysStatement,
+		*influxql.ShowTagValuesCardinalityStatement,
+		*influxql.ShowTagValuesStatement,
+		*influxql.ShowUsersStatement:
+		return true
+	default:
+		return false
+	}
+}
+
+// isQueryManagement returns true if q only contains SHOW QUERIES and KILL
+// QUERY statements.
+func isQueryManagement(q *influxql.Query) bool {
+	for _, stmt := range q.Statements {
+		switch stmt.(type) {
+		case *influxql.ShowQueriesStatement, *influxql.KillQueryStatement:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // async drains the results from an async query and logs a message if it fails.
-func (h *Handler) async(q *influxql.Query, results <-chan *query.Result) {
+func (h *Handler) async(q *influxql.Query, results <-chan *query.Result, logger *zap.Logger) {
 	for r := range results {
 		// Drain the results and do nothing with them.
 		// If it fails, log the failure so there is at least a record of it.
@@ -668,7 +951,7 @@ func (h *Handler) async(q *influxql.Query, results <-chan *query.Result) {
 			if r.Err == query.ErrNotExecuted {
 				continue
 			}
-			h.Logger.Info("Error while running async query",
+			logger.Info("Error while running async query",
 				zap.Stringer("query", q),
 				zap.Error(r.Err))
 		}
@@ -745,7 +1028,7 @@ func (h *Handler) serveWrite(w http.ResponseWriter, r *http.Request, user meta.U
 		}
 
 		if h.Config.WriteTracing {
-			h.Logger.Info("Write handler unable to read bytes from request body")
+			h.Logger.Info("Write handler unable to read bytes from request body", requestIDField(r))
 		}
 		h.httpError(w, err.Error(), http.StatusBadRequest)
 		return
@@ -767,6 +1050,24 @@ func (h *Handler) serveWrite(w http.ResponseWriter, r *http.Request, user meta.U
 		return
 	}
 
+	if h.measurementNamePatternErr != nil {
+		h.Logger.Error("Write refused", zap.Error(h.measurementNamePatternErr), requestIDField(r))
+		atomic.AddInt64(&h.stats.PointsWrittenFail, int64(len(points)))
+		h.httpError(w, h.measurementNamePatternErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Reject the request if any measurement name is invalid.
+	if h.Config.ValidateMeasurementNames || h.measurementNamePattern != nil {
+		for _, p := range points {
+			if err := h.checkMeasurementName(p.Name()); err != nil {
+				atomic.AddInt64(&h.stats.PointsWrittenFail, int64(len(points)))
+				h.httpError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
 	// Determine required consistency level.
 	level := r.URL.Query().Get("consistency")
 	consistency := models.ConsistencyLevelOne
@@ -793,6 +1094,11 @@ func (h *Handler) serveWrite(w http.ResponseWriter, r *http.Request, user meta.U
 		atomic.AddInt64(&h.stats.PointsWrittenDropped, int64(werr.Dropped))
 		h.httpError(w, werr.Error(), http.StatusBadRequest)
 		return
+	} else if influxdb.IsTemporaryError(err) {
+		atomic.AddInt64(&h.stats.PointsWrittenFail, int64(len(points)))
+		w.Header().Set("Retry-After", retryAfter)
+		h.httpError(w, err.Error(), http.StatusServiceUnavailable)
+		return
 	} else if err != nil {
 		atomic.AddInt64(&h.stats.PointsWrittenFail, int64(len(points)))
 		h.httpError(w, err.Error(), http.StatusInternalServerError)
@@ -807,14 +1113,82 @@ func (h *Handler) serveWrite(w http.ResponseWriter, r *http.Request, user meta.U
 	}
 
 	atomic.AddInt64(&h.stats.PointsWrittenOK, int64(len(points)))
+
+	// Report what was written if the client asked for it. Otherwise keep the
+	// empty response that existing clients expect.
+	if r.URL.Query().Get("summary") == "true" {
+		b, _ := json.Marshal(newWriteSummary(points))
+		h.writeHeader(w, http.StatusOK)
+		w.Write(b)
+		w.Write([]byte("\n"))
+		return
+	}
 	h.writeHeader(w, http.StatusNoContent)
 }
 
+// checkMeasurementName returns an error if name fails the measurement name
+// checks enabled in the config.
+func (h *Handler) checkMeasurementName(name []byte) error {
+	if h.Config.ValidateMeasurementNames {
+		if err := validateMeasurementName(name, h.Config.MaxMeasurementNameLength, h.Config.MeasurementNameAllowControlChars); err != nil {
+			return err
+		}
+	}
+	if h.measurementNamePattern != nil && !h.measurementNamePattern.Match(name) {
+		return fmt.Errorf("invalid measurement name %q: does not match %s", name, h.measurementNamePattern)
+	}
+	return nil
+}
+
+// validateMeasurementName returns an error if name is longer than maxLen
+// bytes, contains control characters or consists only of whitespace.
+// A maxLen of zero disables the length check and allowControlChars
+// disables the control character check.
+func validateMeasurementName(name []byte, maxLen int, allowControlChars bool) error {
+	if maxLen > 0 && len(name) > maxLen {
+		return fmt.Errorf("invalid measurement name %q: longer than %d bytes", name, maxLen)
+	} else if len(bytes.TrimSpace(name)) == 0 {
+		return fmt.Errorf("invalid measurement name %q: must not be blank", name)
+	} else if !allowControlChars && bytes.IndexFunc(name, unicode.IsControl) != -1 {
+		return fmt.Errorf("invalid measurement name %q: must not contain control characters", name)
+	}
+	return nil
+}
+
+// WriteSummary describes the result of a successful write request.
+type WriteSummary struct {
+	SeriesWritten int `json:"series_written"`
+	PointsWritten int `json:"points_written"`
+}
+
+// newWriteSummary returns a summary of the series and points in points.
+func newWriteSummary(points []models.Point) WriteSummary {
+	keys := make(map[string]struct{})
+	for _, p := range points {
+		keys[string(p.Key())] = struct{}{}
+	}
+	return WriteSummary{
+		SeriesWritten: len(keys),
+		PointsWritten: len(points),
+	}
+}
+
 // serveOptions returns an empty response to comply with OPTIONS pre-flight requests
 func (h *Handler) serveOptions(w http.ResponseWriter, r *http.Request) {
 	h.writeHeader(w, http.StatusNoContent)
 }
 
+// serveNotFound responds to requests that do not match any route. If the path
+// is served for other methods, the allowed methods are returned with a 405.
+func (h *Handler) serveNotFound(w http.ResponseWriter, r *http.Request) {
+	if methods := h.methods[r.URL.Path]; len(methods) > 0 {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		h.httpError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	h.httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+}
+
 // servePing returns a simple response to let the client know the server is running.
 func (h *Handler) servePing(w http.ResponseWriter, r *http.Request) {
 	verbose := r.URL.Query().Get("verbose")
@@ -862,6 +1236,37 @@ func convertToEpoch(r *query.Result, epoch string) {
 	}
 }
 
+// roundFloats rounds the float values in the result to the given number of
+// decimal places.
+func roundFloats(r *query.Result, precision int) {
+	for _, s := range r.Series {
+		for _, v := range s.Values {
+			for i := range v {
+				if f, ok := v[i].(float64); ok {
+					v[i], _ = strconv.ParseFloat(strconv.FormatFloat(f, 'f', precision, 64), 64)
+				}
+			}
+		}
+	}
+}
+
+// convertIntegersToStrings converts the integer values in the result, including
+// epoch timestamps, to their decimal string representation.
+func convertIntegersToStrings(r *query.Result) {
+	for _, s := range r.Series {
+		for _, v := range s.Values {
+			for i := range v {
+				switch n := v[i].(type) {
+				case int64:
+					v[i] = strconv.FormatInt(n, 10)
+				case uint64:
+					v[i] = strconv.FormatUint(n, 10)
+				}
+			}
+		}
+	}
+}
+
 // servePromWrite receives data in the Prometheus remote write protocol and writes it
 // to the database
 func (h *Handler) servePromWrite(w http.ResponseWriter, r *http.Request, user meta.User) {
@@ -923,7 +1328,7 @@ func (h *Handler) servePromWrite(w http.ResponseWriter, r *http.Request, user me
 		}
 
 		if h.Config.WriteTracing {
-			h.Logger.Info("Prom write handler unable to read bytes from request body")
+			h.Logger.Info("Prom write handler unable to read bytes from request body", requestIDField(r))
 		}
 		h.httpError(w, err.Error(), http.StatusBadRequest)
 		return
@@ -950,7 +1355,7 @@ func (h *Handler) servePromWrite(w http.ResponseWriter, r *http.Request, user me
 	points, err := prometheus.WriteRequestToPoints(&req)
 	if err != nil {
 		if h.Config.WriteTracing {
-			h.Logger.Info("Prom write handler", zap.Error(err))
+			h.Logger.Info("Prom write handler", zap.Error(err), requestIDField(r))
 		}
 
 		if err != prometheus.ErrNaNDropped {
@@ -1090,6 +1495,7 @@ func (h *Handler) servePromRead(w http.ResponseWriter, r *http.Request, user met
 			h.Logger.Info("Prometheus can't read cursor",
 				zap.String("cursor_type", unsupportedCursor),
 				zap.Stringer("series", tags),
+				requestIDField(r),
 			)
 		}
 	}
@@ -1385,7 +1791,8 @@ func (h *Handler) httpError(w http.ResponseWriter, errmsg string, code int) {
 		w.Header().Set("X-InfluxDB-Error", errmsg[:int(sz)])
 	}
 
-	response := Response{Err: errors.New(errmsg)}
+	// The requestID middleware has already set the id on the response.
+	response := Response{Err: errors.New(errmsg), RequestID: w.Header().Get("Request-Id")}
 	if rw, ok := w.(ResponseWriter); ok {
 		h.writeHeader(w, code)
 		rw.WriteResponse(response)
@@ -1510,7 +1917,7 @@ func authenticate(inner func(http.ResponseWriter, *http.Request, meta.User), h *
 				claims, ok := token.Claims.(jwt.MapClaims)
 				if !ok {
 					h.httpError(w, "problem authenticating token", http.StatusInternalServerError)
-					h.Logger.Info("Could not assert JWT token claims as jwt.MapClaims")
+					h.Logger.Info("Could not assert JWT token claims as jwt.MapClaims", requestIDField(r))
 					return
 				}
 
@@ -1617,6 +2024,12 @@ func requestID(inner http.Handler) http.Handler {
 	})
 }
 
+// requestIDField returns the request id set by the requestID handler as a
+// log field.
+func requestIDField(r *http.Request) zap.Field {
+	return zap.String("request_id", r.Header.Get("Request-Id"))
+}
+
 func (h *Handler) logging(inner http.Handler, name string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -1628,7 +2041,8 @@ func (h *Handler) logging(inner http.Handler, name string) http.Handler {
 		if l.Status()/100 == 5 {
 			errStr := l.Header().Get("X-InfluxDB-Error")
 			if errStr != "" {
-				h.Logger.Error(fmt.Sprintf("[%d] - %q", l.Status(), errStr))
+				h.Logger.Error(fmt.Sprintf("[%d] - %q", l.Status(), errStr),
+					requestIDField(r))
 			}
 		}
 	})
@@ -1686,16 +2100,18 @@ type Store interface {
 
 // Response represents a list of statement results.
 type Response struct {
-	Results []*query.Result
-	Err     error
+	Results   []*query.Result
+	Err       error
+	RequestID string
 }
 
 // MarshalJSON encodes a Response struct into JSON.
 func (r Response) MarshalJSON() ([]byte, error) {
 	// Define a struct that outputs "error" as a string.
 	var o struct {
-		Results []*query.Result `json:"results,omitempty"`
-		Err     string          `json:"error,omitempty"`
+		Results   []*query.Result `json:"results,omitempty"`
+		Err       string          `json:"error,omitempty"`
+		RequestID string          `json:"request_id,omitempty"`
 	}
 
 	// Copy fields to output struct.
@@ -1703,6 +2119,7 @@ func (r Response) MarshalJSON() ([]byte, error) {
 	if r.Err != nil {
 		o.Err = r.Err.Error()
 	}
+	o.RequestID = r.RequestID
 
 	return json.Marshal(&o)
 }
@@ -1710,8 +2127,9 @@ func (r Response) MarshalJSON() ([]byte, error) {
 // UnmarshalJSON decodes the data into the Response struct.
 func (r *Response) UnmarshalJSON(b []byte) error {
 	var o struct {
-		Results []*query.Result `json:"results,omitempty"`
-		Err     string          `json:"error,omitempty"`
+		Results   []*query.Result `json:"results,omitempty"`
+		Err       string          `json:"error,omitempty"`
+		RequestID string          `json:"request_id,omitempty"`
 	}
 
 	err := json.Unmarshal(b, &o)
@@ -1719,6 +2137,7 @@ func (r *Response) UnmarshalJSON(b []byte) error {
 		return err
 	}
 	r.Results = o.Results
+	r.RequestID = o.RequestID
 	if o.Err != "" {
 		r.Err = errors.New(o.Err)
 	}
@@ -1739,6 +2158,10 @@ func (r *Response) Error() error {
 	return nil
 }
 
+// retryAfter is the number of seconds a throttled or temporarily failed
+// client is asked to wait before retrying the request.
+const retryAfter = "1"
+
 // Throttler represents an HTTP throttler that limits the number of concurrent
 // requests being processed as well as the number of enqueued requests.
 type Throttler struct {
@@ -1772,43 +2195,69 @@ func (t *Throttler) Handler(h http.Handler) http.Handler {
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Start a timer to limit enqueued request times.
-		var timerCh <-chan time.Time
-		if timeout > 0 {
-			timer := time.NewTimer(timeout)
-			defer timer.Stop()
-			timerCh = timer.C
-		}
-
-		// Wait for a spot in the queue.
-		if cap(t.enqueued) > cap(t.current) {
-			select {
-			case t.enqueued <- struct{}{}:
-				defer func() { <-t.enqueued }()
-			default:
-				t.Logger.Warn("request throttled, queue full", zap.Duration("d", timeout))
-				http.Error(w, "request throttled, queue full", http.StatusServiceUnavailable)
-				return
-			}
+		release, ok := t.wait(w, timeout)
+		if !ok {
+			return
 		}
+		defer release()
+
+		// Execute request.
+		h.ServeHTTP(w, r)
+	})
+}
+
+// acquire waits for a spot to process a request. If the request is throttled,
+// an error is written to w and ok is false. Otherwise release must be called
+// once the request has been processed.
+func (t *Throttler) acquire(w http.ResponseWriter) (release func(), ok bool) {
+	if cap(t.current) == 0 {
+		return func() {}, true
+	}
+	return t.wait(w, t.EnqueueTimeout)
+}
 
-		// First check if we can immediately send in to current because there is
-		// available capacity. This helps reduce racyness in tests.
+// wait waits up to timeout for a spot to process a request.
+func (t *Throttler) wait(w http.ResponseWriter, timeout time.Duration) (release func(), ok bool) {
+	// Start a timer to limit enqueued request times.
+	var timerCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timerCh = timer.C
+	}
+
+	// Wait for a spot in the queue.
+	dequeue := func() {}
+	if cap(t.enqueued) > cap(t.current) {
 		select {
-		case t.current <- struct{}{}:
+		case t.enqueued <- struct{}{}:
+			dequeue = func() { <-t.enqueued }
 		default:
-			// Wait for a spot in the list of concurrent requests, but allow checking the timeout.
-			select {
-			case t.current <- struct{}{}:
-			case <-timerCh:
-				t.Logger.Warn("request throttled, exceeds timeout", zap.Duration("d", timeout))
-				http.Error(w, "request throttled, exceeds timeout", http.StatusServiceUnavailable)
-				return
-			}
+			t.Logger.Warn("request throttled, queue full", zap.Duration("d", timeout))
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "request throttled, queue full", http.StatusServiceUnavailable)
+			return nil, false
 		}
-		defer func() { <-t.current }()
+	}
 
-		// Execute request.
-		h.ServeHTTP(w, r)
-	})
+	// First check if we can immediately send in to current because there is
+	// available capacity. This helps reduce racyness in tests.
+	select {
+	case t.current <- struct{}{}:
+	default:
+		// Wait for a spot in the list of concurrent requests, but allow checking the timeout.
+		select {
+		case t.current <- struct{}{}:
+		case <-timerCh:
+			dequeue()
+			t.Logger.Warn("request throttled, exceeds timeout", zap.Duration("d", timeout))
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "request throttled, exceeds timeout", http.StatusServiceUnavailable)
+			return nil, false
+		}
+	}
+	return func() {
+		<-t.current
+		dequeue()
+	}, true
 }
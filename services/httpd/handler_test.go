@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"mime/multipart"
@@ -13,7 +14,9 @@ import (
 	"net/url"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -22,6 +25,7 @@ import (
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
 	"github.com/google/go-cmp/cmp"
+	"github.com/influxdata/influxdb/coordinator"
 	"github.com/influxdata/influxdb/internal"
 	"github.com/influxdata/influxdb/logger"
 	"github.com/influxdata/influxdb/models"
@@ -31,6 +35,8 @@ import (
 	"github.com/influxdata/influxdb/services/meta"
 	"github.com/influxdata/influxdb/tsdb"
 	"github.com/influxdata/influxql"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 // Ensure the handler returns results from a query (including nil results).
@@ -56,6 +62,140 @@ func TestHandler_Query(t *testing.T) {
 	}
 }
 
+// Ensure float values are rounded when a float precision is configured.
+func TestHandler_Query_FloatPrecision(t *testing.T) {
+	config := httpd.NewConfig()
+	config.FloatPrecision = 4
+	h := NewHandlerWithConfig(config)
+	h.StatementExecutor.ExecuteStatementFn = func(stmt influxql.Statement, ctx *query.ExecutionContext) error {
+		ctx.Results <- &query.Result{StatementID: 0, Series: models.Rows([]*models.Row{{
+			Name:    "cpu",
+			Columns: []string{"time", "value", "count"},
+			Values:  [][]interface{}{{int64(0), 1.23456789012345, int64(3)}},
+		}})}
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewJSONRequest("GET", "/query?db=foo&q=SELECT+*+FROM+cpu", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if body := strings.TrimSpace(w.Body.String()); body != `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value","count"],"values":[[0,1.2346,3]]}]}]}` {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+// Ensure the query statistics trailers match the returned results.
+func TestHandler_Query_StatsTrailers(t *testing.T) {
+	h := NewHandler(false)
+	h.StatementExecutor.ExecuteStatementFn = func(stmt influxql.Statement, ctx *query.ExecutionContext) error {
+		ctx.Results <- &query.Result{StatementID: 0, Series: models.Rows([]*models.Row{
+			{Name: "cpu", Tags: map[string]string{"host": "a"}, Values: [][]interface{}{{1}, {2}}, Partial: true},
+		}), Partial: true}
+		ctx.Results <- &query.Result{StatementID: 0, Series: models.Rows([]*models.Row{
+			{Name: "cpu", Tags: map[string]string{"host": "a"}, Values: [][]interface{}{{3}}},
+			{Name: "cpu", Tags: map[string]string{"host": "b"}, Values: [][]interface{}{{4}}},
+		})}
+		return nil
+	}
+
+	for _, params := range []string{"", "&chunked=true"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, MustNewJSONRequest("GET", "/query?db=foo&q=SELECT+*+FROM+cpu"+params, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status: %d", w.Code)
+		}
+
+		trailer := w.Result().Trailer
+		if got, exp := trailer.Get("X-Influxdb-Query-Points"), "4"; got != exp {
+			t.Errorf("unexpected points trailer for %q: got=%s exp=%s", params, got, exp)
+		}
+		if got, exp := trailer.Get("X-Influxdb-Query-Series"), "2"; got != exp {
+			t.Errorf("unexpected series trailer for %q: got=%s exp=%s", params, got, exp)
+		}
+		if got := trailer.Get("X-Influxdb-Query-Elapsed-Ms"); got == "" {
+			t.Errorf("expected elapsed trailer for %q", params)
+		}
+	}
+}
+
+// Ensure integers are encoded as strings when int64_as_string is set.
+func TestHandler_Query_Int64AsString(t *testing.T) {
+	h := NewHandler(false)
+	h.StatementExecutor.ExecuteStatementFn = func(stmt influxql.Statement, ctx *query.ExecutionContext) error {
+		ctx.Results <- &query.Result{StatementID: 0, Series: models.Rows([]*models.Row{{
+			Name:    "cpu",
+			Columns: []string{"time", "value"},
+			Values:  [][]interface{}{{time.Unix(0, 10).UTC(), int64(9223372036854775000)}},
+		}})}
+		return nil
+	}
+
+	for _, tt := range []struct {
+		params string
+		exp    string
+	}{
+		{params: "", exp: `[["1970-01-01T00:00:00.00000001Z",9223372036854775000]]`},
+		{params: "&int64_as_string=true", exp: `[["1970-01-01T00:00:00.00000001Z","9223372036854775000"]]`},
+		{params: "&int64_as_string=true&epoch=ns", exp: `[["10","9223372036854775000"]]`},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, MustNewJSONRequest("GET", "/query?db=foo&q=SELECT+*+FROM+cpu"+tt.params, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status: %d", w.Code)
+		} else if body := w.Body.String(); !strings.Contains(body, `"values":`+tt.exp) {
+			t.Errorf("unexpected body for %q: %s", tt.params, body)
+		}
+	}
+}
+
+// Ensure queries beyond the concurrent query limit are rejected with a 503.
+func TestHandler_Query_Throttled(t *testing.T) {
+	config := httpd.NewConfig()
+	config.MaxConcurrentQueryLimit = 1
+	config.EnqueuedQueryTimeout = time.Millisecond
+	h := NewHandlerWithConfig(config)
+
+	begin, end := make(chan struct{}), make(chan struct{})
+	h.StatementExecutor.ExecuteStatementFn = func(stmt influxql.Statement, ctx *query.ExecutionContext) error {
+		if _, ok := stmt.(*influxql.ShowQueriesStatement); ok {
+			return h.Handler.QueryExecutor.TaskManager.ExecuteStatement(stmt, ctx)
+		}
+		begin <- struct{}{}
+		<-end
+		return ctx.Send(&query.Result{StatementID: 0})
+	}
+
+	// The first query should execute and block.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), MustNewJSONRequest("GET", "/query?db=foo&q=SELECT+*+FROM+bar", nil))
+	}()
+	<-begin
+
+	// The second query should time out waiting for a slot.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewJSONRequest("GET", "/query?db=foo&q=SELECT+*+FROM+bar", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if got := w.Header().Get("Retry-After"); got == "" {
+		t.Fatal("expected Retry-After header")
+	}
+
+	// Running queries can still be listed while the limit is reached.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewJSONRequest("GET", "/query?q=SHOW+QUERIES", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if !strings.Contains(w.Body.String(), "SELECT * FROM bar") {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+
+	close(end)
+	<-done
+}
+
 // Ensure the handler returns results from a query passed as a file.
 func TestHandler_Query_File(t *testing.T) {
 	h := NewHandler(false)
@@ -94,6 +234,44 @@ func TestHandler_Query_File(t *testing.T) {
 	}
 }
 
+// Ensure the handler accepts a query passed in a form-encoded body.
+func TestHandler_Query_Form(t *testing.T) {
+	h := NewHandler(false)
+	core, logs := observer.New(zap.DebugLevel)
+	h.Handler.Logger = zap.New(core)
+	h.StatementExecutor.ExecuteStatementFn = func(stmt influxql.Statement, ctx *query.ExecutionContext) error {
+		if stmt.String() != `SELECT * FROM bar` {
+			t.Fatalf("unexpected query: %s", stmt.String())
+		} else if ctx.Database != `foo` {
+			t.Fatalf("unexpected db: %s", ctx.Database)
+		}
+		ctx.Results <- &query.Result{StatementID: 1, Series: models.Rows([]*models.Row{{Name: "series0"}})}
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewJSONRequest("GET", "/query?db=foo&q=SELECT+*+FROM+bar", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+	exp := w.Body.String()
+
+	// The form value for db should be preferred over the one in the URL.
+	form := url.Values{"db": {"foo"}, "q": {"SELECT * FROM bar"}}
+	r := MustNewJSONRequest("POST", "/query?db=bar", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if got := w.Body.String(); got != exp {
+		t.Fatalf("unexpected body: got=%s exp=%s", got, exp)
+	} else if n := logs.FilterField(zap.String("param", "db")).Len(); n != 1 {
+		t.Fatalf("expected one warning for the db parameter, got %d", n)
+	}
+}
+
 // Test query with user authentication.
 func TestHandler_Query_Auth(t *testing.T) {
 	// Create the handler to be tested.
@@ -183,7 +361,7 @@ func TestHandler_Query_Auth(t *testing.T) {
 	h.ServeHTTP(w, req)
 	if w.Code != http.StatusUnauthorized {
 		t.Fatalf("unexpected status: %d: %s", w.Code, w.Body.String())
-	} else if body := strings.TrimSpace(w.Body.String()); body != `{"error":"signature is invalid"}` {
+	} else if body := strings.TrimSpace(w.Body.String()); body != fmt.Sprintf(`{"error":"signature is invalid","request_id":%q}`, w.Header().Get("X-Request-Id")) {
 		t.Fatalf("unexpected body: %s", body)
 	}
 
@@ -195,7 +373,7 @@ func TestHandler_Query_Auth(t *testing.T) {
 	h.ServeHTTP(w, req)
 	if w.Code != http.StatusUnauthorized {
 		t.Fatalf("unexpected status: %d: %s", w.Code, w.Body.String())
-	} else if body := strings.TrimSpace(w.Body.String()); body != `{"error":"user not found"}` {
+	} else if body := strings.TrimSpace(w.Body.String()); body != fmt.Sprintf(`{"error":"user not found","request_id":%q}`, w.Header().Get("X-Request-Id")) {
 		t.Fatalf("unexpected body: %s", body)
 	}
 
@@ -223,7 +401,7 @@ func TestHandler_Query_Auth(t *testing.T) {
 	h.ServeHTTP(w, req)
 	if w.Code != http.StatusUnauthorized {
 		t.Fatalf("unexpected status: %d: %s", w.Code, w.Body.String())
-	} else if body := strings.TrimSpace(w.Body.String()); body != `{"error":"token expiration required"}` {
+	} else if body := strings.TrimSpace(w.Body.String()); body != fmt.Sprintf(`{"error":"token expiration required","request_id":%q}`, w.Header().Get("X-Request-Id")) {
 		t.Fatalf("unexpected body: %s", body)
 	}
 
@@ -275,6 +453,31 @@ func TestHandler_Query_MergeResults(t *testing.T) {
 	}
 }
 
+// Ensure rows for the same series are only merged when their columns match.
+func TestHandler_Query_MergeResults_ColumnMismatch(t *testing.T) {
+	h := NewHandler(false)
+	h.StatementExecutor.ExecuteStatementFn = func(stmt influxql.Statement, ctx *query.ExecutionContext) error {
+		ctx.Results <- &query.Result{StatementID: 1, Series: models.Rows([]*models.Row{
+			{Name: "cpu", Columns: []string{"time", "value"}, Values: [][]interface{}{{1, 2}}},
+		})}
+		ctx.Results <- &query.Result{StatementID: 1, Series: models.Rows([]*models.Row{
+			{Name: "cpu", Columns: []string{"time", "value"}, Values: [][]interface{}{{2, 3}}},
+		})}
+		ctx.Results <- &query.Result{StatementID: 1, Series: models.Rows([]*models.Row{
+			{Name: "cpu", Columns: []string{"time", "host", "value"}, Values: [][]interface{}{{3, "a", 4}}},
+		})}
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewJSONRequest("GET", "/query?db=foo&q=SELECT+*+FROM+cpu", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if body := strings.TrimSpace(w.Body.String()); body != `{"results":[{"statement_id":1,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,2],[2,3]]},{"name":"cpu","columns":["time","host","value"],"values":[[3,"a",4]]}]}]}` {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
 // Ensure the handler merges results from the same statement.
 func TestHandler_Query_MergeEmptyResults(t *testing.T) {
 	h := NewHandler(false)
@@ -358,7 +561,7 @@ func TestHandler_Query_ErrQueryRequired(t *testing.T) {
 	h.ServeHTTP(w, MustNewJSONRequest("GET", "/query", nil))
 	if w.Code != http.StatusBadRequest {
 		t.Fatalf("unexpected status: %d", w.Code)
-	} else if body := strings.TrimSpace(w.Body.String()); body != `{"error":"missing required parameter \"q\""}` {
+	} else if body := strings.TrimSpace(w.Body.String()); body != fmt.Sprintf(`{"error":"missing required parameter \"q\"","request_id":%q}`, w.Header().Get("X-Request-Id")) {
 		t.Fatalf("unexpected body: %s", body)
 	}
 }
@@ -370,7 +573,7 @@ func TestHandler_Query_ErrInvalidQuery(t *testing.T) {
 	h.ServeHTTP(w, MustNewJSONRequest("GET", "/query?q=SELECT", nil))
 	if w.Code != http.StatusBadRequest {
 		t.Fatalf("unexpected status: %d", w.Code)
-	} else if body := strings.TrimSpace(w.Body.String()); body != `{"error":"error parsing query: found EOF, expected identifier, string, number, bool at line 1, char 8"}` {
+	} else if body := strings.TrimSpace(w.Body.String()); body != fmt.Sprintf(`{"error":"error parsing query: found EOF, expected identifier, string, number, bool at line 1, char 8","request_id":%q}`, w.Header().Get("X-Request-Id")) {
 		t.Fatalf("unexpected body: %s", body)
 	}
 }
@@ -935,6 +1138,181 @@ func TestHandler_Write_SuppressLog(t *testing.T) {
 	}
 }
 
+// Ensure the write endpoint reports the number of series and points written when asked.
+func TestHandler_Write_Summary(t *testing.T) {
+	h := NewHandler(false)
+	h.MetaClient.DatabaseFn = func(name string) *meta.DatabaseInfo {
+		return &meta.DatabaseInfo{}
+	}
+	var n int
+	h.PointsWriter.WritePointsFn = func(_, _ string, _ models.ConsistencyLevel, _ meta.User, points []models.Point) error {
+		n = len(points)
+		return nil
+	}
+
+	b := strings.NewReader("cpu,host=server01 value=1 1\ncpu,host=server01 value=2 2\ncpu,host=server02 value=3 3\n")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("POST", "/write?db=foo&summary=true", b))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if n != 3 {
+		t.Fatalf("unexpected number of points written: %d", n)
+	} else if body := strings.TrimSpace(w.Body.String()); body != `{"series_written":2,"points_written":3}` {
+		t.Fatalf("unexpected body: %s", body)
+	}
+
+	// Without the summary parameter the response must remain empty.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("POST", "/write?db=foo", strings.NewReader("cpu value=1\n")))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if w.Body.Len() != 0 {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler only serves requests under the configured path prefix.
+func TestHandler_PathPrefix(t *testing.T) {
+	config := httpd.NewConfig()
+	config.PathPrefix = "/influxdb/"
+	h := NewHandlerWithConfig(config)
+
+	for _, tt := range []struct {
+		path string
+		code int
+	}{
+		{path: "/influxdb/ping", code: http.StatusNoContent},
+		{path: "/ping", code: http.StatusNotFound},
+		{path: "/influxdbping", code: http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, MustNewRequest("GET", tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: unexpected status: %d", tt.path, w.Code)
+		} else if w.Header().Get("X-Request-Id") == "" {
+			t.Errorf("%s: expected X-Request-Id header", tt.path)
+		}
+	}
+}
+
+// Ensure the handler asks the client to retry when a write fails temporarily.
+func TestHandler_Write_TemporaryError(t *testing.T) {
+	h := NewHandler(false)
+	h.MetaClient.DatabaseFn = func(name string) *meta.DatabaseInfo {
+		return &meta.DatabaseInfo{}
+	}
+	h.PointsWriter.WritePointsFn = func(_, _ string, _ models.ConsistencyLevel, _ meta.User, _ []models.Point) error {
+		return coordinator.ErrTimeout
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("POST", "/write?db=foo", strings.NewReader("cpu value=1")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if got := w.Header().Get("Retry-After"); got == "" {
+		t.Fatal("expected Retry-After header")
+	} else if body := strings.TrimSpace(w.Body.String()); body != fmt.Sprintf(`{"error":"timeout","request_id":%q}`, w.Header().Get("X-Request-Id")) {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+// Ensure the handler rejects writes containing invalid measurement names.
+func TestHandler_Write_ValidateMeasurementNames(t *testing.T) {
+	for _, tt := range []struct {
+		body              string
+		allowControlChars bool
+		code              int
+	}{
+		{body: "cpu value=1", code: http.StatusNoContent},
+		{body: strings.Repeat("m", 255) + " value=1", code: http.StatusNoContent},
+		{body: strings.Repeat("m", 256) + " value=1", code: http.StatusBadRequest},
+		{body: "cpu\x01 value=1", code: http.StatusBadRequest},
+		{body: "cpu value=1\n\\  value=1", code: http.StatusBadRequest},
+		{body: "cpu\x01 value=1", allowControlChars: true, code: http.StatusNoContent},
+		{body: strings.Repeat("m", 256) + " value=1", allowControlChars: true, code: http.StatusBadRequest},
+		{body: "cpu value=1\n\\  value=1", allowControlChars: true, code: http.StatusBadRequest},
+	} {
+		t.Run(fmt.Sprintf("%.20q/%v", tt.body, tt.allowControlChars), func(t *testing.T) {
+			config := httpd.NewConfig()
+			config.MeasurementNameAllowControlChars = tt.allowControlChars
+			h := NewHandlerWithConfig(config)
+			h.MetaClient.DatabaseFn = func(name string) *meta.DatabaseInfo {
+				return &meta.DatabaseInfo{}
+			}
+			var called bool
+			h.PointsWriter.WritePointsFn = func(_, _ string, _ models.ConsistencyLevel, _ meta.User, _ []models.Point) error {
+				called = true
+				return nil
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, MustNewRequest("POST", "/write?db=foo", strings.NewReader(tt.body)))
+			if w.Code != tt.code {
+				t.Fatalf("unexpected status: %d: %s", w.Code, w.Body.String())
+			} else if called != (tt.code == http.StatusNoContent) {
+				t.Fatalf("unexpected call to WritePoints: %v", called)
+			}
+		})
+	}
+}
+
+// Ensure the handler rejects writes with measurement names not matching the configured pattern.
+func TestHandler_Write_MeasurementNamePattern(t *testing.T) {
+	config := httpd.NewConfig()
+	config.MeasurementNamePattern = `^[a-zA-Z][a-zA-Z0-9._-]*$`
+	h := NewHandlerWithConfig(config)
+	h.MetaClient.DatabaseFn = func(name string) *meta.DatabaseInfo {
+		return &meta.DatabaseInfo{}
+	}
+	var n int
+	h.PointsWriter.WritePointsFn = func(_, _ string, _ models.ConsistencyLevel, _ meta.User, points []models.Point) error {
+		n += len(points)
+		return nil
+	}
+
+	for _, tt := range []struct {
+		body string
+		code int
+	}{
+		{body: "cpu.load_1-min value=1", code: http.StatusNoContent},
+		{body: "cpu value=1\n1cpu value=1", code: http.StatusBadRequest},
+		{body: "cpu/load value=1", code: http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, MustNewRequest("POST", "/write?db=foo", strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Errorf("%q: unexpected status: %d", tt.body, w.Code)
+		}
+	}
+
+	if n != 1 {
+		t.Fatalf("unexpected number of points written: %d", n)
+	}
+}
+
+// Ensure the handler refuses writes instead of panicking when the measurement
+// name pattern was not validated and does not compile.
+func TestHandler_Write_InvalidMeasurementNamePattern(t *testing.T) {
+	config := httpd.NewConfig()
+	config.MeasurementNamePattern = `^[a-z+$`
+	h := NewHandlerWithConfig(config)
+	h.MetaClient.DatabaseFn = func(name string) *meta.DatabaseInfo {
+		return &meta.DatabaseInfo{}
+	}
+	h.PointsWriter.WritePointsFn = func(_, _ string, _ models.ConsistencyLevel, _ meta.User, _ []models.Point) error {
+		t.Fatal("unexpected call to WritePoints")
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewRequest("POST", "/write?db=foo", strings.NewReader("cpu value=1")))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if !strings.Contains(w.Body.String(), "invalid measurement-name-pattern") {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
 // onlyReader implements io.Reader only to ensure Request.ContentLength is not set
 type onlyReader struct {
 	r io.Reader
@@ -983,6 +1361,322 @@ func TestHandler_Write_NegativeMaxBodySize(t *testing.T) {
 	}
 }
 
+// Ensure server errors are logged with the id of the request that caused them.
+func TestHandler_XRequestId_ErrorLog(t *testing.T) {
+	h := NewHandler(false)
+	h.CLFLogger = log.New(ioutil.Discard, "", 0)
+	core, logs := observer.New(zap.DebugLevel)
+	h.Handler.Logger = zap.New(core)
+	h.MetaClient.DatabaseFn = func(name string) *meta.DatabaseInfo {
+		return &meta.DatabaseInfo{}
+	}
+	h.PointsWriter.WritePointsFn = func(_, _ string, _ models.ConsistencyLevel, _ meta.User, _ []models.Point) error {
+		return errors.New("write failed")
+	}
+
+	req := MustNewRequest("POST", "/write?db=foo", strings.NewReader("cpu value=1\n"))
+	req.Header.Set("X-Request-Id", "abc123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if got, exp := w.Header().Get("X-Request-Id"), "abc123"; got != exp {
+		t.Fatalf("X-Request-Id header was %s, expected %s", got, exp)
+	} else if body := strings.TrimSpace(w.Body.String()); body != `{"error":"write failed","request_id":"abc123"}` {
+		t.Fatalf("unexpected body: %s", body)
+	}
+
+	entries := logs.FilterField(zap.String("request_id", "abc123")).All()
+	if len(entries) != 1 {
+		t.Fatalf("expected one error log entry with the request id, got %d", len(entries))
+	}
+}
+
+// Ensure the pprof endpoints are only served when enabled and, if pprof
+// authentication is enabled, only to admin users.
+func TestHandler_Pprof(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		h := NewHandler(false)
+		h.Config.PprofEnabled = false
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, MustNewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("unexpected status: %d", w.Code)
+		}
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		h := NewHandler(false)
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, MustNewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status: %d", w.Code)
+		}
+	})
+
+	t.Run("Auth", func(t *testing.T) {
+		config := httpd.NewConfig()
+		config.AuthEnabled = true
+		config.PprofAuthEnabled = true
+		h := NewHandlerWithConfig(config)
+		h.MetaClient.AdminUserExistsFn = func() bool { return true }
+		h.MetaClient.AuthenticateFn = func(u, p string) (meta.User, error) {
+			switch u {
+			case "admin":
+				return &meta.UserInfo{Name: u, Admin: true}, nil
+			case "user":
+				return &meta.UserInfo{Name: u}, nil
+			}
+			return nil, meta.ErrUserNotFound
+		}
+
+		for _, tt := range []struct {
+			user string
+			code int
+		}{
+			{user: "", code: http.StatusUnauthorized},
+			{user: "user", code: http.StatusForbidden},
+			{user: "admin", code: http.StatusOK},
+		} {
+			req := MustNewRequest("GET", "/debug/pprof/goroutine?debug=1", nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, "pass")
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.code {
+				t.Errorf("unexpected status for user %q: got=%d exp=%d", tt.user, w.Code, tt.code)
+			}
+		}
+	})
+}
+
+// Ensure the debug endpoints are only served to admin users when debug
+// authentication is enabled.
+func TestHandler_Debug_Auth(t *testing.T) {
+	config := httpd.NewConfig()
+	config.AuthEnabled = true
+	config.DebugAuthEnabled = true
+	h := NewHandlerWithConfig(config)
+	h.MetaClient.AdminUserExistsFn = func() bool { return true }
+	h.MetaClient.AuthenticateFn = func(u, p string) (meta.User, error) {
+		switch u {
+		case "admin":
+			return &meta.UserInfo{Name: u, Admin: true}, nil
+		case "user":
+			return &meta.UserInfo{Name: u}, nil
+		}
+		return nil, meta.ErrUserNotFound
+	}
+
+	for _, tt := range []struct {
+		path string
+		user string
+		code int
+	}{
+		{path: "/debug/vars", user: "", code: http.StatusUnauthorized},
+		{path: "/debug/vars", user: "user", code: http.StatusForbidden},
+		{path: "/debug/requests?seconds=0", user: "", code: http.StatusUnauthorized},
+		{path: "/debug/requests?seconds=0", user: "user", code: http.StatusForbidden},
+		{path: "/debug/requests?seconds=0", user: "admin", code: http.StatusOK},
+	} {
+		req := MustNewRequest("GET", tt.path, nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, "pass")
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: unexpected status for user %q: got=%d exp=%d", tt.path, tt.user, w.Code, tt.code)
+		} else if rid := w.Header().Get("X-Request-Id"); rid == "" {
+			t.Errorf("%s: expected X-Request-Id header for user %q", tt.path, tt.user)
+		} else if tt.code != http.StatusOK && !strings.Contains(w.Body.String(), fmt.Sprintf(`"request_id":%q`, rid)) {
+			t.Errorf("%s: expected request id in body for user %q: %s", tt.path, tt.user, w.Body.String())
+		}
+	}
+}
+
+// Ensure the handler tracks the state of connections to the server.
+func TestHandler_ConnState(t *testing.T) {
+	h := NewHandler(false)
+	begin, end := make(chan struct{}), make(chan struct{})
+	h.StatementExecutor.ExecuteStatementFn = func(stmt influxql.Statement, ctx *query.ExecutionContext) error {
+		begin <- struct{}{}
+		<-end
+		return ctx.Send(&query.Result{StatementID: 0})
+	}
+
+	s := httptest.NewUnstartedServer(h)
+	s.Config.ConnState = h.Handler.ConnState
+	s.Start()
+	defer s.Close()
+
+	stat := func(name string) int64 {
+		return h.Statistics(nil)[0].Values[name].(int64)
+	}
+	waitFor := func(name string, want int64) {
+		for deadline := time.Now().Add(5 * time.Second); stat(name) != want; {
+			if time.Now().After(deadline) {
+				t.Fatalf("unexpected %s: got=%d want=%d", name, stat(name), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Start two queries that block until released.
+	client := &http.Client{Transport: &http.Transport{}}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(s.URL + "/query?db=foo&q=SELECT+*+FROM+bar")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	<-begin
+	<-begin
+
+	if got := stat("connActive"); got != 2 {
+		t.Fatalf("unexpected active connections: %d", got)
+	} else if got := stat("connOpen"); got != 2 {
+		t.Fatalf("unexpected open connections: %d", got)
+	}
+
+	// Once the queries finish the connections become idle.
+	close(end)
+	wg.Wait()
+	waitFor("connActive", 0)
+	waitFor("connIdle", 2)
+
+	// Closing the idle connections removes them.
+	client.Transport.(*http.Transport).CloseIdleConnections()
+	waitFor("connOpen", 0)
+	if got := stat("conn"); got != 2 {
+		t.Fatalf("unexpected total connections: %d", got)
+	}
+}
+
+// Ensure CORS preflight requests succeed for every API endpoint.
+func TestHandler_Options(t *testing.T) {
+	h := NewHandler(false)
+
+	for _, path := range []string{"/query", "/write", "/api/v1/prom/write", "/api/v1/prom/read", "/v2/query", "/ping", "/status"} {
+		req := MustNewRequest("OPTIONS", path, nil)
+		req.Header.Set("Origin", "http://example.com")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: unexpected status: %d", path, w.Code)
+		} else if got := w.Header().Get("Access-Control-Allow-Origin"); got != "http://example.com" {
+			t.Errorf("%s: unexpected Access-Control-Allow-Origin header: %q", path, got)
+		} else if got := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, "POST") {
+			t.Errorf("%s: unexpected Access-Control-Allow-Methods header: %q", path, got)
+		}
+	}
+}
+
+// Ensure unsupported methods and unknown paths return structured errors.
+func TestHandler_NotFound(t *testing.T) {
+	h := NewHandler(false)
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		code   int
+		allow  []string
+	}{
+		{method: "PUT", path: "/write", code: http.StatusMethodNotAllowed, allow: []string{"OPTIONS", "POST"}},
+		{method: "DELETE", path: "/query", code: http.StatusMethodNotAllowed, allow: []string{"GET", "HEAD", "OPTIONS", "POST"}},
+		{method: "GET", path: "/foo", code: http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, MustNewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s %s: unexpected status: %d", tt.method, tt.path, w.Code)
+			continue
+		}
+
+		var allow []string
+		if v := w.Header().Get("Allow"); v != "" {
+			allow = strings.Split(v, ", ")
+		}
+		sort.Strings(allow)
+		if !reflect.DeepEqual(allow, tt.allow) {
+			t.Errorf("%s %s: unexpected Allow header: %v", tt.method, tt.path, allow)
+		}
+
+		rid := w.Header().Get("X-Request-Id")
+		if rid == "" {
+			t.Errorf("%s %s: expected X-Request-Id header", tt.method, tt.path)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != fmt.Sprintf(`{"error":%q,"request_id":%q}`, http.StatusText(tt.code), rid) {
+			t.Errorf("%s %s: unexpected body: %s", tt.method, tt.path, body)
+		}
+	}
+}
+
+// Ensure HEAD on the query endpoint returns the response headers without a body.
+func TestHandler_Query_Head(t *testing.T) {
+	h := NewHandler(false)
+	h.StatementExecutor.ExecuteStatementFn = func(stmt influxql.Statement, ctx *query.ExecutionContext) error {
+		return ctx.Send(&query.Result{StatementID: 0, Series: models.Rows{{Name: "series0"}}})
+	}
+
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	resp, err := http.Head(s.URL + "/query?db=foo&q=SELECT+*+FROM+bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	} else if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Fatalf("unexpected content type: %q", got)
+	} else if got := resp.Header.Get("X-Influxdb-Version"); got == "" {
+		t.Fatal("expected X-Influxdb-Version header")
+	}
+
+	if b, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	} else if len(b) != 0 {
+		t.Fatalf("unexpected body: %s", b)
+	}
+}
+
+// Ensure HEAD on the query endpoint never executes statements that change data.
+func TestHandler_Query_Head_ReadOnly(t *testing.T) {
+	h := NewHandler(false)
+	h.StatementExecutor.ExecuteStatementFn = func(stmt influxql.Statement, ctx *query.ExecutionContext) error {
+		t.Fatalf("unexpected statement execution: %s", stmt)
+		return nil
+	}
+
+	for _, q := range []string{
+		"DROP DATABASE foo",
+		"SELECT * INTO bar FROM foo",
+		"SHOW DATABASES; CREATE USER admin WITH PASSWORD 'admin'",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, MustNewRequest("HEAD", "/query?q="+url.QueryEscape(q), nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: unexpected status: %d", q, w.Code)
+		}
+	}
+}
+
 // Ensure X-Forwarded-For header writes the correct log message.
 func TestHandler_XForwardedFor(t *testing.T) {
 	var buf bytes.Buffer
@@ -4,6 +4,7 @@ import (
 	"encoding/csv"
 	"encoding/json"
 	"io"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
@@ -93,11 +94,11 @@ type jsonFormatter struct {
 }
 
 func (f *jsonFormatter) WriteResponse(w io.Writer, resp Response) (err error) {
-	var b []byte
-	if f.Pretty {
-		b, err = json.MarshalIndent(resp, "", "    ")
-	} else {
-		b, err = json.Marshal(resp)
+	b, err := f.marshal(resp)
+	if err != nil && nullNonFiniteFloats(resp) {
+		// JSON cannot represent NaN or infinite floats. Encode them as null
+		// rather than failing the entire response.
+		b, err = f.marshal(resp)
 	}
 
 	if err != nil {
@@ -110,6 +111,32 @@ func (f *jsonFormatter) WriteResponse(w io.Writer, resp Response) (err error) {
 	return err
 }
 
+func (f *jsonFormatter) marshal(resp Response) ([]byte, error) {
+	if f.Pretty {
+		return json.MarshalIndent(resp, "", "    ")
+	}
+	return json.Marshal(resp)
+}
+
+// nullNonFiniteFloats replaces NaN and infinite float values in the response
+// with nil. It reports whether any value was replaced.
+func nullNonFiniteFloats(resp Response) bool {
+	var replaced bool
+	for _, result := range resp.Results {
+		for _, row := range result.Series {
+			for _, values := range row.Values {
+				for i, v := range values {
+					if v, ok := v.(float64); ok && (math.IsNaN(v) || math.IsInf(v, 0)) {
+						values[i] = nil
+						replaced = true
+					}
+				}
+			}
+		}
+	}
+	return replaced
+}
+
 type csvFormatter struct {
 	statementID int
 	columns     []string
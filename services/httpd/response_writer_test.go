@@ -73,6 +73,41 @@ cpu,"host=server01,region=uswest",70,9223372036854775808
 	}
 }
 
+func TestResponseWriter_JSON_NonFiniteFloats(t *testing.T) {
+	r := &http.Request{
+		Header: make(http.Header),
+		URL:    &url.URL{},
+	}
+	w := httptest.NewRecorder()
+
+	writer := httpd.NewResponseWriter(w, r)
+	if _, err := writer.WriteResponse(httpd.Response{
+		Results: []*query.Result{
+			{
+				StatementID: 0,
+				Series: []*models.Row{
+					{
+						Name:    "cpu",
+						Columns: []string{"time", "value"},
+						Values: [][]interface{}{
+							{int64(10), float64(2.5)},
+							{int64(20), math.NaN()},
+							{int64(30), math.Inf(1)},
+							{int64(40), math.Inf(-1)},
+						},
+					},
+				},
+			},
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if got, want := strings.TrimSpace(w.Body.String()), `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[10,2.5],[20,null],[30,null],[40,null]]}]}]}`; got != want {
+		t.Errorf("unexpected output:\n\ngot=%v\nwant=%s", got, want)
+	}
+}
+
 func TestResponseWriter_MessagePack(t *testing.T) {
 	header := make(http.Header)
 	header.Set("Accept", "application/x-msgpack")
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -42,12 +43,19 @@ const (
 	// Prometheus stats
 	statPromWriteRequest = "promWriteReq" // Number of write requests to the promtheus endpoint
 	statPromReadRequest  = "promReadReq"  // Number of read requests to the prometheus endpoint
+
+	// Connection stats
+	statConnections       = "conn"       // Number of connections accepted.
+	statConnectionsOpen   = "connOpen"   // Number of currently open connections.
+	statConnectionsActive = "connActive" // Number of open connections currently serving a request.
+	statConnectionsIdle   = "connIdle"   // Number of open connections waiting for a new request.
 )
 
 // Service manages the listener and handler for an HTTP endpoint.
 type Service struct {
 	ln        net.Listener
 	addr      string
+	network   string
 	https     bool
 	cert      string
 	key       string
@@ -69,7 +77,8 @@ type Service struct {
 // NewService returns a new instance of Service.
 func NewService(c Config) *Service {
 	s := &Service{
-		addr:           c.BindAddress,
+		addr:           bindAddress(c.BindAddress),
+		network:        c.BindNetwork,
 		https:          c.HTTPSEnabled,
 		cert:           c.HTTPSCertificate,
 		key:            c.HTTPSPrivateKey,
@@ -88,6 +97,9 @@ func NewService(c Config) *Service {
 	if s.key == "" {
 		s.key = s.cert
 	}
+	if s.network == "" {
+		s.network = DefaultBindNetwork
+	}
 	if c.UnixSocketGroup != nil {
 		s.unixSocketGroup = int(*c.UnixSocketGroup)
 	}
@@ -95,10 +107,23 @@ func NewService(c Config) *Service {
 	return s
 }
 
+// bindAddress returns addr with an empty host if addr is only a port number,
+// so that "8086" listens on all interfaces like ":8086" does.
+func bindAddress(addr string) string {
+	if _, err := strconv.ParseUint(addr, 10, 16); err == nil {
+		return ":" + addr
+	}
+	return addr
+}
+
 // Open starts the service.
 func (s *Service) Open() error {
 	s.Logger.Info("Starting HTTP service", zap.Bool("authentication", s.Handler.Config.AuthEnabled))
 
+	if err := s.Handler.measurementNamePatternErr; err != nil {
+		return err
+	}
+
 	s.Handler.Open()
 
 	// Open listener.
@@ -111,14 +136,14 @@ func (s *Service) Open() error {
 		tlsConfig := s.tlsConfig.Clone()
 		tlsConfig.Certificates = []tls.Certificate{cert}
 
-		listener, err := tls.Listen("tcp", s.addr, tlsConfig)
+		listener, err := tls.Listen(s.network, s.addr, tlsConfig)
 		if err != nil {
 			return err
 		}
 
 		s.ln = listener
 	} else {
-		listener, err := net.Listen("tcp", s.addr)
+		listener, err := net.Listen(s.network, s.addr)
 		if err != nil {
 			return err
 		}
@@ -246,7 +271,11 @@ func (s *Service) serveUnixSocket() {
 func (s *Service) serve(listener net.Listener) {
 	// The listener was closed so exit
 	// See https://github.com/golang/go/issues/4373
-	err := http.Serve(listener, s.Handler)
+	srv := &http.Server{
+		Handler:   s.Handler,
+		ConnState: s.Handler.ConnState,
+	}
+	err := srv.Serve(listener)
 	if err != nil && !strings.Contains(err.Error(), "closed") {
 		s.err <- fmt.Errorf("listener failed: addr=%s, err=%s", s.Addr(), err)
 	}
@@ -0,0 +1,85 @@
+package httpd_test
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/influxdata/influxdb/services/httpd"
+)
+
+// Ensure the service listens on all interfaces when only a port is given.
+func TestService_Open_PortOnly(t *testing.T) {
+	c := httpd.NewConfig()
+	c.BindAddress = "0"
+	s := httpd.NewService(c)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	addr, ok := s.Addr().(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("unexpected address: %v", s.Addr())
+	} else if !addr.IP.IsUnspecified() {
+		t.Fatalf("unexpected ip: %s", addr.IP)
+	} else if addr.Port == 0 {
+		t.Fatal("expected a port to be assigned")
+	}
+}
+
+// Ensure the service can listen on and serve requests from an IPv6 address.
+func TestService_Open_IPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback not available")
+	}
+	ln.Close()
+
+	c := httpd.NewConfig()
+	c.BindAddress = "[::1]:0"
+	s := httpd.NewService(c)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	resp, err := http.Get("http://" + s.BoundHTTPAddr() + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+}
+
+// Ensure the service only listens on IPv4 when bind-network is tcp4.
+func TestService_Open_TCP4(t *testing.T) {
+	c := httpd.NewConfig()
+	c.BindAddress = "localhost:0"
+	c.BindNetwork = "tcp4"
+	s := httpd.NewService(c)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if addr, ok := s.Addr().(*net.TCPAddr); !ok {
+		t.Fatalf("unexpected address: %v", s.Addr())
+	} else if addr.IP.To4() == nil {
+		t.Fatalf("unexpected ip: %s", addr.IP)
+	}
+}
+
+// Ensure the service fails to open with an invalid measurement name pattern.
+func TestService_Open_InvalidMeasurementNamePattern(t *testing.T) {
+	c := httpd.NewConfig()
+	c.BindAddress = "127.0.0.1:0"
+	c.MeasurementNamePattern = `^[a-z+$`
+	s := httpd.NewService(c)
+	if err := s.Open(); err == nil {
+		s.Close()
+		t.Fatal("expected error")
+	}
+}
@@ -37,7 +37,8 @@ func init() {
 			&Query{
 				name:    "create database should error with some unquoted names",
 				command: `CREATE DATABASE 0xdb0`,
-				exp:     `{"error":"error parsing query: found 0xdb0, expected identifier at line 1, char 17"}`,
+				exp:     `^\{"error":"error parsing query: found 0xdb0, expected identifier at line 1, char 17","request_id":"[^"]+"\}$`,
+				pattern: true,
 			},
 			&Query{
 				name:    "create database should error with invalid characters",
@@ -47,17 +48,20 @@ func init() {
 			&Query{
 				name:    "create database with retention duration should error with bad retention duration",
 				command: `CREATE DATABASE db0 WITH DURATION xyz`,
-				exp:     `{"error":"error parsing query: found xyz, expected duration at line 1, char 35"}`,
+				exp:     `^\{"error":"error parsing query: found xyz, expected duration at line 1, char 35","request_id":"[^"]+"\}$`,
+				pattern: true,
 			},
 			&Query{
 				name:    "create database with retention replication should error with bad retention replication number",
 				command: `CREATE DATABASE db0 WITH REPLICATION xyz`,
-				exp:     `{"error":"error parsing query: found xyz, expected integer at line 1, char 38"}`,
+				exp:     `^\{"error":"error parsing query: found xyz, expected integer at line 1, char 38","request_id":"[^"]+"\}$`,
+				pattern: true,
 			},
 			&Query{
 				name:    "create database with retention name should error with missing retention name",
 				command: `CREATE DATABASE db0 WITH NAME`,
-				exp:     `{"error":"error parsing query: found EOF, expected identifier at line 1, char 31"}`,
+				exp:     `^\{"error":"error parsing query: found EOF, expected identifier at line 1, char 31","request_id":"[^"]+"\}$`,
+				pattern: true,
 			},
 			&Query{
 				name:    "show database should succeed",
@@ -82,7 +86,8 @@ func init() {
 			&Query{
 				name:    "create database should error with bad retention duration",
 				command: `CREATE DATABASE db1 WITH DURATION xyz`,
-				exp:     `{"error":"error parsing query: found xyz, expected duration at line 1, char 35"}`,
+				exp:     `^\{"error":"error parsing query: found xyz, expected duration at line 1, char 35","request_id":"[^"]+"\}$`,
+				pattern: true,
 			},
 			&Query{
 				name:    "show database should succeed",
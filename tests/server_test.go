@@ -530,17 +530,20 @@ func TestServer_UserCommands(t *testing.T) {
 			&Query{
 				name:    "bad create user request",
 				command: `CREATE USER 0xBAD WITH PASSWORD pwd1337`,
-				exp:     `{"error":"error parsing query: found 0xBAD, expected identifier at line 1, char 13"}`,
+				exp:     `^\{"error":"error parsing query: found 0xBAD, expected identifier at line 1, char 13","request_id":"[^"]+"\}$`,
+				pattern: true,
 			},
 			&Query{
 				name:    "bad create user request, no name",
 				command: `CREATE USER WITH PASSWORD pwd1337`,
-				exp:     `{"error":"error parsing query: found WITH, expected identifier at line 1, char 13"}`,
+				exp:     `^\{"error":"error parsing query: found WITH, expected identifier at line 1, char 13","request_id":"[^"]+"\}$`,
+				pattern: true,
 			},
 			&Query{
 				name:    "bad create user request, no password",
 				command: `CREATE USER jdoe`,
-				exp:     `{"error":"error parsing query: found EOF, expected WITH at line 1, char 18"}`,
+				exp:     `^\{"error":"error parsing query: found EOF, expected WITH at line 1, char 18","request_id":"[^"]+"\}$`,
+				pattern: true,
 			},
 			&Query{
 				name:    "drop user",